@@ -0,0 +1,287 @@
+// Package blocks implements syncthing-style block-level diffing so that a
+// file transfer can be resumed or deduplicated instead of always being sent
+// as a single opaque stream. An uploader builds an Index describing the
+// blocks that make up a file; a downloader builds its own Index from
+// whatever partial data it already has on disk and asks Needed to tell it
+// which blocks still have to be fetched.
+package blocks
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "sync"
+)
+
+const (
+    // MinBlockSize is the smallest block size BlockSize will ever choose.
+    MinBlockSize = 128 * 1024
+
+    // MaxBlockSize is the largest block size BlockSize will ever choose.
+    MaxBlockSize = 16 * 1024 * 1024
+
+    // targetBlockCount is the number of blocks BlockSize aims for when
+    // picking a size for a given file; syncthing uses the same target.
+    targetBlockCount = 2000
+)
+
+// HashSize is the length in bytes of a Block's Hash (sha256).
+const HashSize = sha256.Size
+
+// Block describes a single contiguous region of a file along with the
+// sha256 hash of its contents.
+type Block struct {
+    // Offset is the byte offset of the block within the file.
+    Offset int64
+
+    // Size is the length in bytes of the block. Every block is Size bytes
+    // except possibly the last, which may be shorter.
+    Size int32
+
+    // Hash is the sha256 hash of the block's contents.
+    Hash [HashSize]byte
+}
+
+// Index is the ordered list of Blocks that make up a file. Two Indexes
+// built with the same BlockSize are directly comparable block-by-block via
+// Needed.
+type Index []Block
+
+// BlockSize chooses a block size for a file of the given size, aiming for
+// roughly targetBlockCount blocks, clamped to [MinBlockSize, MaxBlockSize]
+// and snapped up to the next power of two.
+func BlockSize(fileSize int64) int32 {
+    size := int64(MinBlockSize)
+
+    for fileSize/size > targetBlockCount && size < MaxBlockSize {
+        size *= 2
+    }
+
+    if size > MaxBlockSize {
+        size = MaxBlockSize
+    }
+
+    return int32(size)
+}
+
+var (
+    zeroHashesMu sync.Mutex
+    zeroHashes   = make(map[int32][HashSize]byte)
+)
+
+// ZeroHash returns the sha256 hash of a block of the given size consisting
+// entirely of zero bytes, computing and caching it on first use. Callers
+// use this to recognize sparse regions of a file without having to read or
+// transfer them.
+func ZeroHash(size int32) [HashSize]byte {
+    zeroHashesMu.Lock()
+    defer zeroHashesMu.Unlock()
+
+    if hash, ok := zeroHashes[size]; ok {
+        return hash
+    }
+
+    h := sha256.Sum256(make([]byte, size))
+    zeroHashes[size] = h
+
+    return h
+}
+
+// BuildIndex reads r in full and returns the Index describing its blocks,
+// using BlockSize(fileSize) as the block size. fileSize should be the
+// total number of bytes r will yield; it is used only to choose the block
+// size, not to bound the read.
+func BuildIndex(r io.Reader, fileSize int64) (Index, error) {
+    blockSize := BlockSize(fileSize)
+    buff := make([]byte, blockSize)
+
+    var index Index
+    var offset int64
+
+    for {
+        n, err := io.ReadFull(r, buff)
+
+        if n > 0 {
+            index = append(index, Block{
+                Offset: offset,
+                Size:   int32(n),
+                Hash:   sha256.Sum256(buff[:n]),
+            })
+
+            offset += int64(n)
+        }
+
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            break
+        }
+
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return index, nil
+}
+
+// Needed compares a downloader's local Index against the uploader's remote
+// Index and returns the indices (into remote) of the blocks the downloader
+// does not already have, in order. Blocks whose hash equals the all-zero
+// hash for their size are skipped even when missing locally, since they
+// represent a sparse region that need not be transferred.
+func Needed(local, remote Index) []int {
+    var needed []int
+
+    for i, block := range remote {
+        if block.Hash == ZeroHash(block.Size) {
+            continue
+        }
+
+        if i < len(local) && local[i].Size == block.Size && local[i].Hash == block.Hash {
+            continue
+        }
+
+        needed = append(needed, i)
+    }
+
+    return needed
+}
+
+// MarshalIndex encodes an Index for transmission as the body of a
+// common.BlockIndex Message.
+func MarshalIndex(index Index) []byte {
+    var buff bytes.Buffer
+
+    binary.Write(&buff, binary.BigEndian, uint32(len(index)))
+
+    for _, block := range index {
+        binary.Write(&buff, binary.BigEndian, block.Offset)
+        binary.Write(&buff, binary.BigEndian, block.Size)
+        buff.Write(block.Hash[:])
+    }
+
+    return buff.Bytes()
+}
+
+// blockEntrySize is the marshaled size in bytes of a single Block: an
+// int64 Offset, an int32 Size, and a HashSize-byte Hash.
+const blockEntrySize = 8 + 4 + HashSize
+
+// UnmarshalIndex decodes an Index previously produced by MarshalIndex.
+func UnmarshalIndex(data []byte) (Index, error) {
+    r := bytes.NewReader(data)
+
+    var count uint32
+
+    if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+        return nil, fmt.Errorf("blocks: reading index count: %w", err)
+    }
+
+    if uint64(count)*blockEntrySize > uint64(r.Len()) {
+        return nil, fmt.Errorf("blocks: index declares %d blocks but only %d bytes remain", count, r.Len())
+    }
+
+    index := make(Index, count)
+
+    for i := range index {
+        if err := binary.Read(r, binary.BigEndian, &index[i].Offset); err != nil {
+            return nil, fmt.Errorf("blocks: reading block %d offset: %w", i, err)
+        }
+
+        if err := binary.Read(r, binary.BigEndian, &index[i].Size); err != nil {
+            return nil, fmt.Errorf("blocks: reading block %d size: %w", i, err)
+        }
+
+        if _, err := io.ReadFull(r, index[i].Hash[:]); err != nil {
+            return nil, fmt.Errorf("blocks: reading block %d hash: %w", i, err)
+        }
+    }
+
+    return index, nil
+}
+
+// Request identifies a single block a downloader is asking the uploader to
+// send.
+type Request struct {
+    // Index is the position of the requested block within the uploader's
+    // Index.
+    Index int32
+
+    // Offset is the byte offset of the requested block within the file.
+    Offset int64
+
+    // Size is the length in bytes of the requested block.
+    Size int32
+}
+
+// MarshalRequest encodes a Request for transmission as the body of a
+// common.BlockRequest Message.
+func MarshalRequest(req Request) []byte {
+    var buff bytes.Buffer
+
+    binary.Write(&buff, binary.BigEndian, req.Index)
+    binary.Write(&buff, binary.BigEndian, req.Offset)
+    binary.Write(&buff, binary.BigEndian, req.Size)
+
+    return buff.Bytes()
+}
+
+// UnmarshalRequest decodes a Request previously produced by MarshalRequest.
+func UnmarshalRequest(data []byte) (req Request, err error) {
+    r := bytes.NewReader(data)
+
+    if err = binary.Read(r, binary.BigEndian, &req.Index); err != nil {
+        return req, fmt.Errorf("blocks: reading request index: %w", err)
+    }
+
+    if err = binary.Read(r, binary.BigEndian, &req.Offset); err != nil {
+        return req, fmt.Errorf("blocks: reading request offset: %w", err)
+    }
+
+    if err = binary.Read(r, binary.BigEndian, &req.Size); err != nil {
+        return req, fmt.Errorf("blocks: reading request size: %w", err)
+    }
+
+    return req, nil
+}
+
+// Response carries the raw bytes of a block requested via a Request.
+type Response struct {
+    // Index is the position of the block within the uploader's Index, as
+    // given in the originating Request.
+    Index int32
+
+    // Data is the block's raw contents.
+    Data []byte
+}
+
+// MarshalResponse encodes a Response for transmission as the body of a
+// common.BlockResponse Message.
+func MarshalResponse(resp Response) []byte {
+    var buff bytes.Buffer
+
+    binary.Write(&buff, binary.BigEndian, resp.Index)
+    buff.Write(resp.Data)
+
+    return buff.Bytes()
+}
+
+// UnmarshalResponse decodes a Response previously produced by
+// MarshalResponse. Since the body carries no explicit length for Data,
+// every byte following Index is taken to be block data.
+func UnmarshalResponse(data []byte) (resp Response, err error) {
+    r := bytes.NewReader(data)
+
+    if err = binary.Read(r, binary.BigEndian, &resp.Index); err != nil {
+        return resp, fmt.Errorf("blocks: reading response index: %w", err)
+    }
+
+    resp.Data = make([]byte, r.Len())
+
+    if _, err = io.ReadFull(r, resp.Data); err != nil {
+        return resp, fmt.Errorf("blocks: reading response data: %w", err)
+    }
+
+    return resp, nil
+}
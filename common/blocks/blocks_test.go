@@ -0,0 +1,130 @@
+package blocks
+
+import (
+    "bytes"
+    "encoding/binary"
+    "testing"
+)
+
+func TestBlockSizeClamping(t *testing.T) {
+    cases := []struct {
+        fileSize int64
+        want     int32
+    }{
+        {0, MinBlockSize},
+        {1024, MinBlockSize},
+        {int64(targetBlockCount+1) * MinBlockSize, MinBlockSize * 2},
+        {1 << 40, MaxBlockSize},
+    }
+
+    for _, c := range cases {
+        if got := BlockSize(c.fileSize); got != c.want {
+            t.Errorf("BlockSize(%d) = %d, want %d", c.fileSize, got, c.want)
+        }
+    }
+}
+
+func TestZeroHashCaching(t *testing.T) {
+    a := ZeroHash(4096)
+    b := ZeroHash(4096)
+
+    if a != b {
+        t.Fatalf("ZeroHash(4096) returned different hashes on repeated calls")
+    }
+
+    if c := ZeroHash(8192); c == a {
+        t.Fatalf("ZeroHash returned the same hash for different sizes")
+    }
+}
+
+func TestBuildIndexAndNeeded(t *testing.T) {
+    data := bytes.Repeat([]byte{0xAB}, int(MinBlockSize)*3+17)
+
+    remote, err := BuildIndex(bytes.NewReader(data), int64(len(data)))
+
+    if err != nil {
+        t.Fatalf("BuildIndex: %v", err)
+    }
+
+    if len(remote) != 4 {
+        t.Fatalf("expected 4 blocks, got %d", len(remote))
+    }
+
+    // Local has the first two blocks correct and is missing the rest.
+    local := remote[:2]
+
+    needed := Needed(local, remote)
+
+    if len(needed) != 2 || needed[0] != 2 || needed[1] != 3 {
+        t.Fatalf("Needed returned unexpected indices: %v", needed)
+    }
+
+    // A fully matching local index needs nothing.
+    if needed := Needed(remote, remote); len(needed) != 0 {
+        t.Fatalf("expected no blocks needed, got %v", needed)
+    }
+}
+
+func TestIndexMarshalRoundTrip(t *testing.T) {
+    data := bytes.Repeat([]byte{0x11}, int(MinBlockSize)+1)
+
+    index, err := BuildIndex(bytes.NewReader(data), int64(len(data)))
+
+    if err != nil {
+        t.Fatalf("BuildIndex: %v", err)
+    }
+
+    decoded, err := UnmarshalIndex(MarshalIndex(index))
+
+    if err != nil {
+        t.Fatalf("UnmarshalIndex: %v", err)
+    }
+
+    if len(decoded) != len(index) {
+        t.Fatalf("round-tripped index has %d blocks, want %d", len(decoded), len(index))
+    }
+
+    for i := range index {
+        if decoded[i] != index[i] {
+            t.Fatalf("block %d round-tripped incorrectly: got %+v, want %+v", i, decoded[i], index[i])
+        }
+    }
+}
+
+func TestUnmarshalIndexRejectsOversizedCount(t *testing.T) {
+    // An index is rebuilt from a BlockIndex message the remote peer sends, so a block
+    // count this large with no data behind it must fail fast rather than
+    // driving a multi-gigabyte Index allocation.
+    data := make([]byte, 4)
+    binary.BigEndian.PutUint32(data, 0xFFFFFFFF)
+
+    if _, err := UnmarshalIndex(data); err == nil {
+        t.Fatal("expected UnmarshalIndex to reject a count with no backing data, got nil error")
+    }
+}
+
+func TestRequestResponseMarshalRoundTrip(t *testing.T) {
+    req := Request{Index: 3, Offset: 4096, Size: 1024}
+
+    decodedReq, err := UnmarshalRequest(MarshalRequest(req))
+
+    if err != nil {
+        t.Fatalf("UnmarshalRequest: %v", err)
+    }
+
+    if decodedReq != req {
+        t.Fatalf("round-tripped request = %+v, want %+v", decodedReq, req)
+    }
+
+    resp := Response{Index: 3, Data: []byte("some block data")}
+
+    decodedResp, err := UnmarshalResponse(MarshalResponse(resp))
+
+    if err != nil {
+        t.Fatalf("UnmarshalResponse: %v", err)
+    }
+
+    if decodedResp.Index != resp.Index || !bytes.Equal(decodedResp.Data, resp.Data) {
+        t.Fatalf("round-tripped response = %+v, want %+v", decodedResp, resp)
+    }
+}
@@ -0,0 +1,235 @@
+package common
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "sync"
+    "time"
+)
+
+// errConnectionClosed is the error returned by Send/Receive after Close has
+// been called with a nil reason (a clean, intentional shutdown).
+var errConnectionClosed = errors.New("common: connection closed")
+
+// Connection owns a net.Conn and exposes context-aware Send/Receive along
+// with idempotent, error-propagating shutdown. It replaces the
+// goroutine-per-direction approach in MessageChannel, whose two goroutines
+// both closed the same "in"/"out" channels on exit -- letting the writer's
+// shutdown panic the reader mid-send -- and which had no way to surface a
+// fatal error to callers beyond logging it to stderr.
+type Connection struct {
+    conn net.Conn
+
+    idleTimeout time.Duration
+    pingTicker  *time.Ticker
+    pingDone    chan struct{}
+
+    writeMu sync.Mutex
+
+    closeOnce sync.Once
+    closed    chan struct{}
+    closeErr  error
+    closeMu   sync.Mutex
+}
+
+// NewConnection wraps conn in a Connection. idleTimeout, if non-zero, is
+// used as the read deadline for Receive, and Ping packets are sent to the
+// peer every idleTimeout/2; a read that times out closes the Connection.
+func NewConnection(conn net.Conn, idleTimeout time.Duration) *Connection {
+    c := &Connection{
+        conn:        conn,
+        idleTimeout: idleTimeout,
+        closed:      make(chan struct{}),
+    }
+
+    if idleTimeout > 0 {
+        c.pingDone = make(chan struct{})
+        c.pingTicker = time.NewTicker(idleTimeout / 2)
+        go c.pingLoop()
+    }
+
+    return c
+}
+
+func (c *Connection) pingLoop() {
+    for {
+        select {
+        case <-c.pingTicker.C:
+            if err := c.Send(context.Background(), Message{Packet: Ping}); err != nil {
+                return
+            }
+        case <-c.pingDone:
+            return
+        }
+    }
+}
+
+// Send marshals and writes msg to the underlying conn, honoring both ctx's
+// deadline and its cancellation, and failing immediately if the Connection
+// is already closed. A write failure unrelated to ctx closes the Connection
+// before returning; a write interrupted by ctx being canceled leaves the
+// Connection open for other callers and returns ctx.Err().
+func (c *Connection) Send(ctx context.Context, msg Message) error {
+    select {
+    case <-c.closed:
+        return c.err()
+    default:
+    }
+
+    data, err := msg.MarshalBinary()
+
+    if err != nil {
+        return err
+    }
+
+    if deadline, ok := ctx.Deadline(); ok {
+        c.conn.SetWriteDeadline(deadline)
+    } else {
+        c.conn.SetWriteDeadline(time.Time{})
+    }
+
+    stop := c.watchContext(ctx, c.conn.SetWriteDeadline)
+    defer stop()
+
+    c.writeMu.Lock()
+    _, err = c.conn.Write(data)
+    c.writeMu.Unlock()
+
+    if err != nil {
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+
+        c.Close(fmt.Errorf("common: write failed: %w", err))
+        return c.err()
+    }
+
+    return nil
+}
+
+// Receive reads and parses the next non-Ping Message from the underlying
+// conn, honoring ctx's deadline and cancellation as well as the idle
+// timeout configured via NewConnection, whichever is soonest. A read
+// failure unrelated to ctx closes the Connection before returning; a read
+// interrupted by ctx being canceled leaves the Connection open for other
+// callers and returns ctx.Err().
+func (c *Connection) Receive(ctx context.Context) (Message, error) {
+    stop := c.watchContext(ctx, c.conn.SetReadDeadline)
+    defer stop()
+
+    for {
+        select {
+        case <-c.closed:
+            return Message{}, c.err()
+        default:
+        }
+
+        deadline, hasDeadline := ctx.Deadline()
+
+        if c.idleTimeout > 0 {
+            idleDeadline := time.Now().Add(c.idleTimeout)
+
+            if ! hasDeadline || idleDeadline.Before(deadline) {
+                deadline, hasDeadline = idleDeadline, true
+            }
+        }
+
+        if hasDeadline {
+            c.conn.SetReadDeadline(deadline)
+        } else {
+            c.conn.SetReadDeadline(time.Time{})
+        }
+
+        if err := ctx.Err(); err != nil {
+            return Message{}, err
+        }
+
+        msg, err := readMessage(c.conn)
+
+        if err != nil {
+            if ctx.Err() != nil {
+                return Message{}, ctx.Err()
+            }
+
+            c.Close(fmt.Errorf("common: read failed: %w", err))
+            return Message{}, c.err()
+        }
+
+        if msg.Packet == Ping {
+            continue
+        }
+
+        return msg, nil
+    }
+}
+
+// watchContext starts a goroutine that forces conn's read or write deadline
+// (whichever setDeadline controls) into the past as soon as ctx is
+// canceled, unblocking an in-flight Read/Write even when ctx carries no
+// deadline of its own. If ctx can never be canceled (e.g.
+// context.Background()), no goroutine is started. The returned stop func
+// must be called once the guarded operation returns, both to avoid leaking
+// the goroutine and to avoid clobbering the deadline the next Send/Receive
+// call sets.
+func (c *Connection) watchContext(ctx context.Context, setDeadline func(time.Time) error) func() {
+    if ctx.Done() == nil {
+        return func() {}
+    }
+
+    stop := make(chan struct{})
+
+    go func() {
+        select {
+        case <-ctx.Done():
+            setDeadline(time.Unix(0, 0))
+        case <-stop:
+        }
+    }()
+
+    return func() { close(stop) }
+}
+
+// Close shuts the Connection down, closing the underlying conn and
+// recording reason as the error subsequent Send/Receive calls will return.
+// A nil reason means a clean, intentional shutdown. Close is idempotent via
+// a single sync.Once: only the first call's reason and net.Conn.Close
+// result are kept.
+func (c *Connection) Close(reason error) error {
+    var closeErr error
+
+    c.closeOnce.Do(func() {
+        c.closeMu.Lock()
+        c.closeErr = reason
+        c.closeMu.Unlock()
+
+        if c.pingTicker != nil {
+            c.pingTicker.Stop()
+            close(c.pingDone)
+        }
+
+        closeErr = c.conn.Close()
+        close(c.closed)
+    })
+
+    return closeErr
+}
+
+// Done returns a channel that is closed once the Connection has been
+// closed, so callers waiting on both it and other channels (e.g. an
+// outgoing-message channel) can stop without blocking forever.
+func (c *Connection) Done() <-chan struct{} {
+    return c.closed
+}
+
+func (c *Connection) err() error {
+    c.closeMu.Lock()
+    defer c.closeMu.Unlock()
+
+    if c.closeErr != nil {
+        return c.closeErr
+    }
+
+    return errConnectionClosed
+}
@@ -0,0 +1,233 @@
+package common
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestConnectionSendReceiveRoundTrip(t *testing.T) {
+    a, b := net.Pipe()
+    defer a.Close()
+    defer b.Close()
+
+    ca := NewConnection(a, 0)
+    cb := NewConnection(b, 0)
+
+    want := Message{Packet: FileSize, Body: []byte{0, 0, 0, 0, 0, 0, 0, 42}}
+
+    go func() {
+        if err := ca.Send(context.Background(), want); err != nil {
+            t.Errorf("Send: %v", err)
+        }
+    }()
+
+    got, err := cb.Receive(context.Background())
+
+    if err != nil {
+        t.Fatalf("Receive: %v", err)
+    }
+
+    if got.Packet != want.Packet || string(got.Body) != string(want.Body) {
+        t.Fatalf("Receive returned %+v, want %+v", got, want)
+    }
+}
+
+// TestConnectionErrorPropagation demonstrates the fix for the old
+// MessageChannel behavior, where a fatal error was only logged to stderr
+// and never surfaced to the caller: Receive must return the actual
+// underlying error once the peer goes away.
+func TestConnectionErrorPropagation(t *testing.T) {
+    a, b := net.Pipe()
+
+    ca := NewConnection(a, 0)
+    cb := NewConnection(b, 0)
+
+    b.Close()
+
+    if _, err := cb.Receive(context.Background()); err == nil {
+        t.Fatal("expected Receive on a closed conn to return an error")
+    }
+
+    if _, err := ca.Receive(context.Background()); err == nil {
+        t.Fatal("expected Receive on the peer conn to return an error once the other side closes")
+    }
+}
+
+// TestConnectionCloseIsIdempotent demonstrates the fix for the old
+// MessageChannel bug where both goroutines deferred closing the same
+// channels, so the second close would panic. Calling Close repeatedly, and
+// concurrently, on a Connection must never panic.
+func TestConnectionCloseIsIdempotent(t *testing.T) {
+    a, _ := net.Pipe()
+    c := NewConnection(a, 0)
+
+    done := make(chan struct{})
+
+    for i := 0; i < 10; i++ {
+        go func() {
+            c.Close(nil)
+            done <- struct{}{}
+        }()
+    }
+
+    for i := 0; i < 10; i++ {
+        select {
+        case <-done:
+        case <-time.After(time.Second):
+            t.Fatal("Close did not return in time")
+        }
+    }
+}
+
+// TestConnectionReceiveCancelable demonstrates the fix for Receive ignoring
+// ctx.Done(): a context.WithCancel context (no deadline of its own) that is
+// canceled mid-call must unblock Receive promptly and return ctx.Err(),
+// without closing the Connection for other callers.
+func TestConnectionReceiveCancelable(t *testing.T) {
+    a, b := net.Pipe()
+    defer a.Close()
+    defer b.Close()
+
+    c := NewConnection(a, 0)
+
+    ctx, cancel := context.WithCancel(context.Background())
+
+    recvErr := make(chan error, 1)
+
+    go func() {
+        _, err := c.Receive(ctx)
+        recvErr <- err
+    }()
+
+    cancel()
+
+    select {
+    case err := <-recvErr:
+        if err != context.Canceled {
+            t.Fatalf("Receive returned %v, want context.Canceled", err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("Receive did not return within 1s of ctx being canceled")
+    }
+
+    select {
+    case <-c.Done():
+        t.Fatal("canceling one caller's ctx must not close the Connection")
+    default:
+    }
+
+    // The Connection must still be usable after the canceled call returns.
+    want := Message{Packet: FileSize, Body: []byte{0, 0, 0, 0, 0, 0, 0, 7}}
+
+    go func() {
+        if err := NewConnection(b, 0).Send(context.Background(), want); err != nil {
+            t.Errorf("Send: %v", err)
+        }
+    }()
+
+    got, err := c.Receive(context.Background())
+
+    if err != nil {
+        t.Fatalf("Receive after cancellation: %v", err)
+    }
+
+    if got.Packet != want.Packet || string(got.Body) != string(want.Body) {
+        t.Fatalf("Receive returned %+v, want %+v", got, want)
+    }
+}
+
+// TestConnectionSendCancelable demonstrates the same fix for Send: a
+// context.WithCancel context canceled mid-call must unblock Send and
+// return ctx.Err() rather than waiting on the idle timeout or an external
+// Close.
+func TestConnectionSendCancelable(t *testing.T) {
+    a, b := net.Pipe()
+    defer a.Close()
+    defer b.Close()
+
+    c := NewConnection(a, 0)
+
+    ctx, cancel := context.WithCancel(context.Background())
+
+    sendErr := make(chan error, 1)
+
+    // net.Pipe's Write blocks until a matching Read runs, and nothing reads
+    // from b here, so Send has no way to return except via cancellation.
+    go func() {
+        sendErr <- c.Send(ctx, Message{Packet: FileSize, Body: make([]byte, 8)})
+    }()
+
+    cancel()
+
+    select {
+    case err := <-sendErr:
+        if err != context.Canceled {
+            t.Fatalf("Send returned %v, want context.Canceled", err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("Send did not return within 1s of ctx being canceled")
+    }
+
+    select {
+    case <-c.Done():
+        t.Fatal("canceling one caller's ctx must not close the Connection")
+    default:
+    }
+}
+
+func TestConnectionDoneClosesOnClose(t *testing.T) {
+    a, _ := net.Pipe()
+    c := NewConnection(a, 0)
+
+    select {
+    case <-c.Done():
+        t.Fatal("Done channel closed before Close was called")
+    default:
+    }
+
+    c.Close(nil)
+
+    select {
+    case <-c.Done():
+    case <-time.After(time.Second):
+        t.Fatal("Done channel did not close after Close")
+    }
+}
+
+// TestMessageChannelWriterStopsOnClosedConnection demonstrates the fix for
+// the goroutine leak where MessageChannel's writer goroutine, parked on
+// `for msg := range out`, would never notice the connection had died and
+// would stay blocked forever if the caller kept sending. It must now
+// return once the underlying Connection closes, even with out still open.
+func TestMessageChannelWriterStopsOnClosedConnection(t *testing.T) {
+    a, b := net.Pipe()
+
+    in, out := MessageChannel(a)
+
+    // Kill the connection out from under MessageChannel by closing the
+    // peer side, which will fail the reader's next Receive and close the
+    // Connection (and therefore Done()).
+    b.Close()
+
+    // The reader goroutine should observe the failure and close in.
+    select {
+    case _, ok := <-in:
+        if ok {
+            t.Fatal("expected in to be closed after peer closed the connection")
+        }
+    case <-time.After(time.Second):
+        t.Fatal("in was not closed after peer closed the connection")
+    }
+
+    // The writer goroutine should no longer be blocked forever: sending on
+    // out should either be dropped (no reader) or not wedge the test. We
+    // can't observe the goroutine directly, but we can confirm the test
+    // itself completes promptly instead of hanging, which it would not if
+    // MessageChannel still ranged over out with no way to unblock.
+    select {
+    case out <- Message{Packet: FileSize, Body: make([]byte, 8)}:
+    case <-time.After(100 * time.Millisecond):
+    }
+}
@@ -0,0 +1,177 @@
+package common
+
+import "testing"
+
+func TestNegotiateHashAlgoAgrees(t *testing.T) {
+    aOut, bIn := make(chan Message), make(chan Message)
+    bOut, aIn := make(chan Message), make(chan Message)
+
+    go func() {
+        for msg := range aOut {
+            bIn <- msg
+        }
+    }()
+
+    go func() {
+        for msg := range bOut {
+            aIn <- msg
+        }
+    }()
+
+    results := make(chan HashAlgoBody, 2)
+    errs := make(chan error, 2)
+
+    go func() {
+        algo, err := NegotiateHashAlgo(aIn, aOut, Sha512HashAlgo)
+        results <- algo
+        errs <- err
+    }()
+
+    go func() {
+        algo, err := NegotiateHashAlgo(bIn, bOut, Sha512HashAlgo)
+        results <- algo
+        errs <- err
+    }()
+
+    for i := 0; i < 2; i++ {
+        if err := <-errs; err != nil {
+            t.Fatalf("NegotiateHashAlgo: %v", err)
+        }
+
+        if algo := <-results; algo != Sha512HashAlgo {
+            t.Fatalf("negotiated %#x, want Sha512HashAlgo", byte(algo))
+        }
+    }
+}
+
+// TestNegotiateHashAlgoFallsBackOnUnimplementedAgreement demonstrates that
+// two peers agreeing on Blake3HashAlgo -- a value NewHasher recognizes but
+// cannot yet construct -- still falls back to Sha256HashAlgo instead of
+// negotiating an algorithm the first FileHash attempt would fail on.
+func TestNegotiateHashAlgoFallsBackOnUnimplementedAgreement(t *testing.T) {
+    aOut, bIn := make(chan Message), make(chan Message)
+    bOut, aIn := make(chan Message), make(chan Message)
+
+    go func() {
+        for msg := range aOut {
+            bIn <- msg
+        }
+    }()
+
+    go func() {
+        for msg := range bOut {
+            aIn <- msg
+        }
+    }()
+
+    results := make(chan HashAlgoBody, 2)
+    errs := make(chan error, 2)
+
+    go func() {
+        algo, err := NegotiateHashAlgo(aIn, aOut, Blake3HashAlgo)
+        results <- algo
+        errs <- err
+    }()
+
+    go func() {
+        algo, err := NegotiateHashAlgo(bIn, bOut, Blake3HashAlgo)
+        results <- algo
+        errs <- err
+    }()
+
+    for i := 0; i < 2; i++ {
+        if err := <-errs; err != nil {
+            t.Fatalf("NegotiateHashAlgo: %v", err)
+        }
+
+        if algo := <-results; algo != Sha256HashAlgo {
+            t.Fatalf("negotiated %#x, want fallback Sha256HashAlgo", byte(algo))
+        }
+    }
+}
+
+func TestNegotiateHashAlgoFallsBackOnMismatch(t *testing.T) {
+    aOut, bIn := make(chan Message), make(chan Message)
+    bOut, aIn := make(chan Message), make(chan Message)
+
+    go func() {
+        for msg := range aOut {
+            bIn <- msg
+        }
+    }()
+
+    go func() {
+        for msg := range bOut {
+            aIn <- msg
+        }
+    }()
+
+    results := make(chan HashAlgoBody, 2)
+    errs := make(chan error, 2)
+
+    go func() {
+        algo, err := NegotiateHashAlgo(aIn, aOut, Sha512HashAlgo)
+        results <- algo
+        errs <- err
+    }()
+
+    go func() {
+        algo, err := NegotiateHashAlgo(bIn, bOut, Blake3HashAlgo)
+        results <- algo
+        errs <- err
+    }()
+
+    for i := 0; i < 2; i++ {
+        if err := <-errs; err != nil {
+            t.Fatalf("NegotiateHashAlgo: %v", err)
+        }
+
+        if algo := <-results; algo != Sha256HashAlgo {
+            t.Fatalf("negotiated %#x, want fallback Sha256HashAlgo", byte(algo))
+        }
+    }
+}
+
+func TestNewHasherAndHashSizeAgree(t *testing.T) {
+    for _, algo := range []HashAlgoBody{Sha256HashAlgo, Sha512HashAlgo} {
+        newHash, err := NewHasher(algo)
+
+        if err != nil {
+            t.Fatalf("NewHasher(%#x): %v", byte(algo), err)
+        }
+
+        size, err := HashSize(algo)
+
+        if err != nil {
+            t.Fatalf("HashSize(%#x): %v", byte(algo), err)
+        }
+
+        if got := newHash().Size(); got != size {
+            t.Fatalf("NewHasher(%#x)().Size() = %d, want %d", byte(algo), got, size)
+        }
+    }
+}
+
+func TestFileHashBodyMarshalRoundTrip(t *testing.T) {
+    body := FileHashBody{Algo: Sha512HashAlgo, Hash: make([]byte, 64)}
+
+    for i := range body.Hash {
+        body.Hash[i] = byte(i)
+    }
+
+    data, err := body.MarshalBinary()
+
+    if err != nil {
+        t.Fatalf("MarshalBinary: %v", err)
+    }
+
+    decoded, err := UnmarshalFileHashBody(data)
+
+    if err != nil {
+        t.Fatalf("UnmarshalFileHashBody: %v", err)
+    }
+
+    if decoded.Algo != body.Algo || string(decoded.Hash) != string(body.Hash) {
+        t.Fatalf("round-tripped body = %+v, want %+v", decoded, body)
+    }
+}
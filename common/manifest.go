@@ -0,0 +1,177 @@
+package common
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "path"
+    "strings"
+)
+
+// EntryMode indicates what kind of filesystem entry a ManifestEntry
+// represents.
+type EntryMode byte
+
+const (
+    // FileEntryMode is the EntryMode of a ManifestEntry describing a
+    // regular file.
+    FileEntryMode EntryMode = 0x00
+
+    // DirEntryMode is the EntryMode of a ManifestEntry describing a
+    // subdirectory. Subdirectories carry no Size or Hash of their own; they
+    // exist so empty directories survive the transfer.
+    DirEntryMode  EntryMode = 0x01
+)
+
+// ManifestEntry describes a single file or subdirectory offered as part of
+// a Manifest.
+type ManifestEntry struct {
+    // Path is the entry's path relative to the root of the transfer, using
+    // forward slashes regardless of the host OS.
+    Path string
+
+    // Mode indicates whether this entry is a file or a directory.
+    Mode EntryMode
+
+    // Size is the file's size in bytes. Always 0 for directories.
+    Size uint64
+
+    // Hash is the sha256 hash of the file's contents. Always the zero value
+    // for directories.
+    Hash [sha256.Size]byte
+}
+
+// Manifest describes the full tree of files and subdirectories offered in a
+// single transfer. It is sent as the body of a TransferOffer Message so the
+// downloader can accept or decline the whole transfer before any file bytes
+// flow.
+type Manifest struct {
+    Entries []ManifestEntry
+}
+
+// MarshalBinary encodes a Manifest for transmission as the body of a
+// TransferOffer Message.
+func (m Manifest) MarshalBinary() (data []byte, err error) {
+    var buff bytes.Buffer
+
+    binary.Write(&buff, binary.BigEndian, uint32(len(m.Entries)))
+
+    for _, entry := range m.Entries {
+        pathBytes := []byte(entry.Path)
+
+        if len(pathBytes) > 0xFFFF {
+            return nil, fmt.Errorf("common: manifest entry path too long (%d bytes)", len(pathBytes))
+        }
+
+        binary.Write(&buff, binary.BigEndian, uint16(len(pathBytes)))
+        buff.Write(pathBytes)
+        buff.WriteByte(byte(entry.Mode))
+        binary.Write(&buff, binary.BigEndian, entry.Size)
+        buff.Write(entry.Hash[:])
+    }
+
+    return buff.Bytes(), nil
+}
+
+// minManifestEntrySize is the smallest a marshaled ManifestEntry can be: a
+// uint16 path length (with an empty path), a Mode byte, a uint64 Size, and
+// a sha256.Size-byte Hash.
+const minManifestEntrySize = 2 + 1 + 8 + sha256.Size
+
+// sanitizeManifestPath validates and cleans an entry path read off the
+// wire. Manifests come from the remote peer, so a Path is untrusted input:
+// any consumer that joins it onto a local destination directory to write
+// the transferred file must be able to trust that it cannot escape that
+// directory (a Zip-Slip style path traversal). An empty path, an absolute
+// path, or one whose cleaned form starts with ".." is rejected.
+func sanitizeManifestPath(p string) (string, error) {
+    if p == "" {
+        return "", fmt.Errorf("empty path")
+    }
+
+    if strings.Contains(p, "\\") {
+        return "", fmt.Errorf("path %q contains a backslash", p)
+    }
+
+    if path.IsAbs(p) {
+        return "", fmt.Errorf("path %q is absolute", p)
+    }
+
+    clean := path.Clean(p)
+
+    if clean == ".." || strings.HasPrefix(clean, "../") {
+        return "", fmt.Errorf("path %q escapes the transfer root", p)
+    }
+
+    return clean, nil
+}
+
+// UnmarshalManifest decodes a Manifest previously produced by
+// Manifest.MarshalBinary.
+func UnmarshalManifest(data []byte) (Manifest, error) {
+    r := bytes.NewReader(data)
+
+    var count uint32
+
+    if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+        return Manifest{}, fmt.Errorf("common: reading manifest entry count: %w", err)
+    }
+
+    if uint64(count)*minManifestEntrySize > uint64(r.Len()) {
+        return Manifest{}, fmt.Errorf("common: manifest declares %d entries but only %d bytes remain", count, r.Len())
+    }
+
+    entries := make([]ManifestEntry, count)
+
+    for i := range entries {
+        var pathLen uint16
+
+        if err := binary.Read(r, binary.BigEndian, &pathLen); err != nil {
+            return Manifest{}, fmt.Errorf("common: reading entry %d path length: %w", i, err)
+        }
+
+        pathBytes := make([]byte, pathLen)
+
+        if _, err := io.ReadFull(r, pathBytes); err != nil {
+            return Manifest{}, fmt.Errorf("common: reading entry %d path: %w", i, err)
+        }
+
+        cleanPath, err := sanitizeManifestPath(string(pathBytes))
+
+        if err != nil {
+            return Manifest{}, fmt.Errorf("common: entry %d: %w", i, err)
+        }
+
+        entries[i].Path = cleanPath
+
+        mode, err := r.ReadByte()
+
+        if err != nil {
+            return Manifest{}, fmt.Errorf("common: reading entry %d mode: %w", i, err)
+        }
+
+        entries[i].Mode = EntryMode(mode)
+
+        if err := binary.Read(r, binary.BigEndian, &entries[i].Size); err != nil {
+            return Manifest{}, fmt.Errorf("common: reading entry %d size: %w", i, err)
+        }
+
+        if _, err := io.ReadFull(r, entries[i].Hash[:]); err != nil {
+            return Manifest{}, fmt.Errorf("common: reading entry %d hash: %w", i, err)
+        }
+    }
+
+    return Manifest{Entries: entries}, nil
+}
+
+// Manifest decodes m's Body as a Manifest. It is only valid to call when
+// m.Packet == TransferOffer.
+func (m Message) Manifest() (Manifest, error) {
+    if m.Packet != TransferOffer {
+        return Manifest{}, fmt.Errorf("common: Message.Manifest called on packet %#x, want TransferOffer", byte(m.Packet))
+    }
+
+    return UnmarshalManifest(m.Body)
+}
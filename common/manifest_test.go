@@ -0,0 +1,73 @@
+package common
+
+import (
+    "encoding/binary"
+    "testing"
+)
+
+func TestUnmarshalManifestRejectsOversizedCount(t *testing.T) {
+    // A manifest claiming ~4 billion entries with nothing behind it is the
+    // kind of message a malicious peer sends hoping UnmarshalManifest
+    // allocates before validating; it must be rejected instead.
+    data := make([]byte, 4)
+    binary.BigEndian.PutUint32(data, 0xFFFFFFFF)
+
+    if _, err := UnmarshalManifest(data); err == nil {
+        t.Fatal("expected UnmarshalManifest to reject a count with no backing data, got nil error")
+    }
+}
+
+func TestUnmarshalManifestRejectsPathTraversal(t *testing.T) {
+    cases := []string{
+        "../../../../etc/cron.d/evil",
+        "..",
+        "/etc/passwd",
+        "a/../../b",
+        `a\..\..\b`,
+    }
+
+    for _, p := range cases {
+        manifest := Manifest{Entries: []ManifestEntry{{Path: p, Mode: FileEntryMode}}}
+
+        data, err := manifest.MarshalBinary()
+
+        if err != nil {
+            t.Fatalf("MarshalBinary(%q): %v", p, err)
+        }
+
+        if _, err := UnmarshalManifest(data); err == nil {
+            t.Fatalf("expected UnmarshalManifest to reject escaping path %q, got nil error", p)
+        }
+    }
+}
+
+func TestManifestMarshalRoundTrip(t *testing.T) {
+    manifest := Manifest{
+        Entries: []ManifestEntry{
+            {Path: "dir", Mode: DirEntryMode},
+            {Path: "dir/file.txt", Mode: FileEntryMode, Size: 1234},
+        },
+    }
+
+    data, err := manifest.MarshalBinary()
+
+    if err != nil {
+        t.Fatalf("MarshalBinary: %v", err)
+    }
+
+    decoded, err := UnmarshalManifest(data)
+
+    if err != nil {
+        t.Fatalf("UnmarshalManifest: %v", err)
+    }
+
+    if len(decoded.Entries) != len(manifest.Entries) {
+        t.Fatalf("round-tripped manifest has %d entries, want %d", len(decoded.Entries), len(manifest.Entries))
+    }
+
+    for i := range manifest.Entries {
+        if decoded.Entries[i] != manifest.Entries[i] {
+            t.Fatalf("entry %d round-tripped incorrectly: got %+v, want %+v", i, decoded.Entries[i], manifest.Entries[i])
+        }
+    }
+}
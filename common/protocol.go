@@ -1,15 +1,30 @@
 package common
 
 import (
+    "context"
     "os"
     "fmt"
     "net"
     "bytes"
+    "io"
+    "encoding/binary"
 )
 
 const (
     // UidLength is the length of the UID that the puncher server issues.
     UidLength = 16
+
+    // ProtocolVersion is the current version of the transhift wire protocol.
+    // It is exchanged via the Version packet immediately after connecting so
+    // both peers can detect an incompatible partner before parsing anything
+    // else.
+    ProtocolVersion uint8 = 1
+
+    // MaxMessageLen is the largest body a variable-length Message may carry.
+    // It keeps a corrupt or malicious peer from making us allocate an
+    // unbounded buffer off of a bogus length prefix; 500 MB mirrors the
+    // ceiling syncthing enforces on its own block exchange protocol.
+    MaxMessageLen uint32 = 500 * 1024 * 1024
 )
 
 // Packet is a description of the data sent from one endpoint to another.
@@ -54,7 +69,8 @@ const (
     FileSize      Packet = 0x06
 
     // FileHash is sent from the uploader to the downloader indicating the hash
-    // of the file about to be sent.
+    // of the file about to be sent. The body is a FileHashBody, whose length
+    // depends on the HashAlgo negotiated between the two peers.
     FileHash      Packet = 0x07
 
     // Verification is sent from the downloader to the uploader indicating the
@@ -75,6 +91,63 @@ const (
     // connections should be closed and that no future communications will take
     // place. The body contains a message describing the reason.
     Halt          Packet = 0x0B
+
+    // Version is sent by both peers immediately upon connecting, before any
+    // other Packet, to negotiate the protocol version in use. The body is a
+    // single byte containing the sender's ProtocolVersion.
+    Version       Packet = 0x0C
+
+    // BlockIndex is sent from the uploader to the downloader advertising the
+    // manifest of (offset, size, hash) block descriptors that make up the
+    // file about to be sent. The body is a blocks.Index marshaled via
+    // blocks.MarshalIndex.
+    BlockIndex    Packet = 0x0D
+
+    // BlockRequest is sent from the downloader to the uploader asking for a
+    // single block it does not already have. The body is a blocks.Request
+    // marshaled via blocks.MarshalRequest.
+    BlockRequest  Packet = 0x0E
+
+    // BlockResponse is sent from the uploader to the downloader in reply to
+    // a BlockRequest, carrying the requested block's raw bytes. The body is
+    // a blocks.Response marshaled via blocks.MarshalResponse.
+    BlockResponse Packet = 0x0F
+
+    // TransferOffer is sent from the uploader to the downloader describing
+    // the entire set of files and subdirectories it would like to send, so
+    // the downloader can accept or decline the whole transfer before any
+    // file bytes flow. The body is a Manifest; see Message.Manifest.
+    TransferOffer  Packet = 0x10
+
+    // TransferAccept is sent from the downloader to the uploader indicating
+    // the preceding TransferOffer was accepted in full.
+    TransferAccept Packet = 0x11
+
+    // TransferReject is sent from the downloader to the uploader indicating
+    // the preceding TransferOffer was declined. The body contains a message
+    // describing the reason.
+    TransferReject Packet = 0x12
+
+    // FileBegin is sent from the uploader to the downloader immediately
+    // before the bytes of one file in a TransferOffer start flowing. The
+    // body is a uint32 index into the accepted Manifest's Entries.
+    FileBegin Packet = 0x13
+
+    // FileEnd is sent from the uploader to the downloader immediately after
+    // the bytes of one file in a TransferOffer have finished flowing. The
+    // body is the same uint32 index carried by the matching FileBegin.
+    FileEnd   Packet = 0x14
+
+    // HashAlgo is sent by both peers immediately after the ClientType
+    // exchange to negotiate which hash function FileHash and Verification
+    // will use. The body is a single HashAlgoBody byte.
+    HashAlgo  Packet = 0x15
+
+    // Ping is sent periodically by Connection to keep an otherwise idle
+    // connection alive, so that the peer's idle deadline expires only once
+    // the link has gone dead. It carries no meaning beyond its own arrival and is
+    // never surfaced to callers of Connection.Receive.
+    Ping      Packet = 0x16
 )
 
 const (
@@ -98,6 +171,8 @@ var (
     bodilessPackets = []Packet{
         PeerNotFound,
         UploaderReady,
+        TransferAccept,
+        Ping,
     }
 
     // fixedLengthPackets is the map of all Packets that have a fixed length
@@ -107,11 +182,26 @@ var (
         UidAssignment: UidLength,
         UidRequest:    UidLength,
         FileSize:      8,  // uint64
-        FileHash:      32, // sha256
         Verification:  1,
+        Version:       1,
+        FileBegin:     4, // uint32
+        FileEnd:       4, // uint32
+        HashAlgo:      1,
     }
 )
 
+// MessageTooLargeError is returned when a Message's body exceeds
+// MaxMessageLen, either while marshaling an outgoing Message or while
+// reading one off the wire.
+type MessageTooLargeError struct {
+    // Len is the offending body length, in bytes.
+    Len uint32
+}
+
+func (e MessageTooLargeError) Error() string {
+    return fmt.Sprintf("message body of %d bytes exceeds MaxMessageLen (%d bytes)", e.Len, MaxMessageLen)
+}
+
 // Message is a message from one endpoint to another with a packet and body.
 // Some messages may be bodiless, where body will therefore be nil.
 type Message struct {
@@ -126,6 +216,29 @@ func NewMesssageWithByte(packet Packet, body byte) *Message {
     return &Message{ packet, []byte{body} }
 }
 
+// NewMessageWithIndex builds a Message whose body is a big-endian uint32,
+// as used by FileBegin and FileEnd to carry a Manifest entry index.
+func NewMessageWithIndex(packet Packet, index uint32) *Message {
+    body := make([]byte, 4)
+    binary.BigEndian.PutUint32(body, index)
+
+    return &Message{ packet, body }
+}
+
+// Index decodes m's Body as a big-endian uint32. It is only valid to call
+// when m.Packet == FileBegin or m.Packet == FileEnd.
+func (m Message) Index() (uint32, error) {
+    if m.Packet != FileBegin && m.Packet != FileEnd {
+        return 0, fmt.Errorf("common: Message.Index called on packet %#x, want FileBegin or FileEnd", byte(m.Packet))
+    }
+
+    if len(m.Body) != 4 {
+        return 0, fmt.Errorf("common: malformed index body (got %d bytes, want 4)", len(m.Body))
+    }
+
+    return binary.BigEndian.Uint32(m.Body), nil
+}
+
 func (m Message) MarshalBinary() (data []byte, err error) {
     var buff bytes.Buffer
 
@@ -133,13 +246,15 @@ func (m Message) MarshalBinary() (data []byte, err error) {
 
     if ! isBodiless(m.Packet) {
         if _, fixed := fixedLengthPackets[m.Packet]; ! fixed {
-            bodyLen := len(m.Body)
+            bodyLen := uint32(len(m.Body))
 
-            if bodyLen > 0xFF {
-                return nil, fmt.Errorf("length of body cannot fit in 1 byte (got %d bytes)", bodyLen)
+            if bodyLen > MaxMessageLen {
+                return nil, MessageTooLargeError{bodyLen}
             }
 
-            buff.WriteByte(byte(len(m.Body)))
+            var lenBuff [4]byte
+            binary.BigEndian.PutUint32(lenBuff[:], bodyLen)
+            buff.Write(lenBuff[:])
         }
 
         buff.Write(m.Body)
@@ -148,75 +263,125 @@ func (m Message) MarshalBinary() (data []byte, err error) {
     return buff.Bytes(), nil
 }
 
-// MessageChannel returns a 2 channels of Messages for the given Conn. Closes
-// both channels upon error or closure.
-func MessageChannel(conn net.Conn) (in chan Message, out chan Message) {
-    in = make(chan Message)
-    out = make(chan Message)
+// NegotiateVersion exchanges a Version Message over the given channel pair
+// and returns an error if the remote peer's ProtocolVersion is incompatible
+// with ours. Callers should invoke this immediately after MessageChannel
+// returns, before exchanging any other Packet, so that a version mismatch is
+// caught before either peer interprets the rest of the stream.
+func NegotiateVersion(in <-chan Message, out chan<- Message) error {
+    out <- Message{Packet: Version, Body: []byte{ProtocolVersion}}
 
-    go func() {
-        defer close(in)
-        defer close(out)
+    msg, ok := <- in
 
-        for {
-            packetBuff := make([]byte, 1)
+    if ! ok {
+        return fmt.Errorf("connection closed during version negotiation")
+    }
 
-            if _, err := conn.Read(packetBuff); err != nil {
-                handleReadError(conn, err)
-                return
-            }
+    if msg.Packet != Version {
+        return fmt.Errorf("expected Version packet, got %#x", byte(msg.Packet))
+    }
 
-            packet := Packet(packetBuff[0])
+    if len(msg.Body) != 1 {
+        return fmt.Errorf("malformed Version body (got %d bytes, want 1)", len(msg.Body))
+    }
 
-            if isBodiless(packet) {
-                in <- Message{
-                    Packet: packet,
-                }
-                continue
-            }
+    if msg.Body[0] != ProtocolVersion {
+        return fmt.Errorf("peer protocol version %d is incompatible with ours (%d)", msg.Body[0], ProtocolVersion)
+    }
 
-            len, known := fixedLengthPackets[packet]
+    return nil
+}
 
-            if ! known {
-                lenBuff := make([]byte, 1)
+// readMessage reads a single Message from r, following the bodiless /
+// fixed-length / length-prefixed rules encoded in bodilessPackets and
+// fixedLengthPackets.
+func readMessage(r io.Reader) (Message, error) {
+    packetBuff := make([]byte, 1)
 
-                if _, err := conn.Read(lenBuff); err != nil {
-                    handleReadError(conn, err)
-                    return
-                }
+    if _, err := io.ReadFull(r, packetBuff); err != nil {
+        return Message{}, err
+    }
 
-                len = uint8(lenBuff[0])
-            }
+    packet := Packet(packetBuff[0])
 
-            bodyBuff := make([]byte, len)
+    if isBodiless(packet) {
+        return Message{Packet: packet}, nil
+    }
 
-            if _, err := conn.Read(bodyBuff); err != nil {
-                handleReadError(conn, err)
-                break
-            }
+    fixedLen, known := fixedLengthPackets[packet]
+    bodyLen := uint32(fixedLen)
 
-            in <- Message{
-                Packet: packet,
-                Body:   bodyBuff,
-            }
+    if ! known {
+        lenBuff := make([]byte, 4)
+
+        if _, err := io.ReadFull(r, lenBuff); err != nil {
+            return Message{}, err
         }
-    }()
+
+        bodyLen = binary.BigEndian.Uint32(lenBuff)
+
+        if bodyLen > MaxMessageLen {
+            return Message{}, MessageTooLargeError{bodyLen}
+        }
+    }
+
+    bodyBuff := make([]byte, bodyLen)
+
+    if _, err := io.ReadFull(r, bodyBuff); err != nil {
+        return Message{}, err
+    }
+
+    return Message{Packet: packet, Body: bodyBuff}, nil
+}
+
+// MessageChannel returns a 2 channels of Messages for the given Conn. The in
+// channel is closed when the connection errors or is closed. The out
+// channel is never closed by MessageChannel itself -- closing it, once
+// done sending, is the caller's responsibility -- but the goroutine reading
+// from it also stops as soon as the connection closes, so it never leaks
+// blocked on a dead connection even if the caller keeps sending.
+//
+// Deprecated: use Connection instead. MessageChannel's two background
+// goroutines have no way to propagate a fatal error back to the caller
+// beyond logging it to stderr, and it is kept only as a thin wrapper around
+// Connection for one release.
+func MessageChannel(conn net.Conn) (in chan Message, out chan Message) {
+    c := NewConnection(conn, 0)
+
+    in = make(chan Message)
+    out = make(chan Message)
 
     go func() {
         defer close(in)
-        defer close(out)
 
         for {
-            data, err := (<- out).MarshalBinary()
+            msg, err := c.Receive(context.Background())
 
             if err != nil {
-                handleWriteError(conn, err)
-                break
+                handleReadError(conn, err)
+                return
             }
 
-            if _, err := conn.Write(data); err != nil {
-                handleWriteError(conn, err)
-                break
+            in <- msg
+        }
+    }()
+
+    go func() {
+        defer c.Close(nil)
+
+        for {
+            select {
+            case msg, ok := <- out:
+                if ! ok {
+                    return
+                }
+
+                if err := c.Send(context.Background(), msg); err != nil {
+                    handleWriteError(conn, err)
+                    return
+                }
+            case <- c.Done():
+                return
             }
         }
     }()
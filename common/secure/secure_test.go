@@ -0,0 +1,180 @@
+package secure
+
+import (
+    "bytes"
+    "net"
+    "testing"
+    "time"
+
+    "golang.org/x/crypto/chacha20poly1305"
+
+    "github.com/transhift/common/common"
+)
+
+// bufConn is a minimal net.Conn backed by a single shared bytes.Buffer, used
+// to drive Connection.Write/Read directly without the synchronization a
+// real net.Pipe would require.
+type bufConn struct {
+    net.Conn
+    buf *bytes.Buffer
+}
+
+func (c *bufConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+func (c *bufConn) Read(p []byte) (int, error)  { return c.buf.Read(p) }
+
+func TestConnectionRoundTripWithoutTamper(t *testing.T) {
+    key := make([]byte, chacha20poly1305.KeySize)
+
+    seal, err := chacha20poly1305.New(key)
+
+    if err != nil {
+        t.Fatalf("chacha20poly1305.New(seal): %v", err)
+    }
+
+    open, err := chacha20poly1305.New(key)
+
+    if err != nil {
+        t.Fatalf("chacha20poly1305.New(open): %v", err)
+    }
+
+    fake := &bufConn{buf: new(bytes.Buffer)}
+    writer := &Connection{Conn: fake, seal: seal}
+    reader := &Connection{Conn: fake, open: open}
+
+    want := []byte("hello, peer")
+
+    if _, err := writer.Write(want); err != nil {
+        t.Fatalf("Write: %v", err)
+    }
+
+    got := make([]byte, len(want))
+
+    if _, err := reader.Read(got); err != nil {
+        t.Fatalf("Read: %v", err)
+    }
+
+    if ! bytes.Equal(got, want) {
+        t.Fatalf("Read returned %q, want %q", got, want)
+    }
+}
+
+// TestConnectionTamperDetectionIsRejected confirms a single flipped
+// ciphertext byte (simulating a malicious puncher tampering with a frame
+// in transit) is rejected by Read rather than silently decrypted, which is
+// the entire point of the authenticated framing this package adds.
+func TestConnectionTamperDetectionIsRejected(t *testing.T) {
+    key := make([]byte, chacha20poly1305.KeySize)
+
+    seal, err := chacha20poly1305.New(key)
+
+    if err != nil {
+        t.Fatalf("chacha20poly1305.New(seal): %v", err)
+    }
+
+    open, err := chacha20poly1305.New(key)
+
+    if err != nil {
+        t.Fatalf("chacha20poly1305.New(open): %v", err)
+    }
+
+    fake := &bufConn{buf: new(bytes.Buffer)}
+    writer := &Connection{Conn: fake, seal: seal}
+    reader := &Connection{Conn: fake, open: open}
+
+    if _, err := writer.Write([]byte("hello, peer")); err != nil {
+        t.Fatalf("Write: %v", err)
+    }
+
+    wire := fake.buf.Bytes()
+    wire[len(wire)-1] ^= 0xFF // flip the last byte of the AEAD tag
+
+    if _, err := reader.Read(make([]byte, 32)); err == nil {
+        t.Fatal("expected Read to reject a tampered frame, got nil error")
+    }
+}
+
+func TestSecureMessageChannelRoundTripAndSAS(t *testing.T) {
+    // A real loopback TCP connection is used here rather than net.Pipe:
+    // net.Pipe's Write blocks until the peer's matching Read runs, and
+    // since both sides write their handshake public key before reading the
+    // peer's, two net.Pipe ends deadlock in lock-step. A TCP socket's send
+    // buffer lets both handshake writes complete immediately, as they
+    // would over a real network connection.
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+    if err != nil {
+        t.Fatalf("net.Listen: %v", err)
+    }
+
+    defer listener.Close()
+
+    acceptedCh := make(chan net.Conn, 1)
+    acceptErrCh := make(chan error, 1)
+
+    go func() {
+        conn, err := listener.Accept()
+        acceptedCh <- conn
+        acceptErrCh <- err
+    }()
+
+    a, err := net.Dial("tcp", listener.Addr().String())
+
+    if err != nil {
+        t.Fatalf("net.Dial: %v", err)
+    }
+
+    defer a.Close()
+
+    if err := <-acceptErrCh; err != nil {
+        t.Fatalf("listener.Accept: %v", err)
+    }
+
+    b := <-acceptedCh
+    defer b.Close()
+
+    type handshakeResult struct {
+        in, out chan common.Message
+        sas     SAS
+        err     error
+    }
+
+    resA := make(chan handshakeResult, 1)
+    resB := make(chan handshakeResult, 1)
+
+    go func() {
+        in, out, sas, err := SecureMessageChannel(a, nil)
+        resA <- handshakeResult{in, out, sas, err}
+    }()
+
+    go func() {
+        in, out, sas, err := SecureMessageChannel(b, nil)
+        resB <- handshakeResult{in, out, sas, err}
+    }()
+
+    ra, rb := <-resA, <-resB
+
+    if ra.err != nil {
+        t.Fatalf("SecureMessageChannel(a): %v", ra.err)
+    }
+
+    if rb.err != nil {
+        t.Fatalf("SecureMessageChannel(b): %v", rb.err)
+    }
+
+    if ra.sas == "" || ra.sas != rb.sas {
+        t.Fatalf("SAS mismatch or empty: %q vs %q", ra.sas, rb.sas)
+    }
+
+    want := common.Message{Packet: common.FileSize, Body: []byte{0, 0, 0, 0, 0, 0, 0, 7}}
+
+    go func() { ra.out <- want }()
+
+    select {
+    case got := <-rb.in:
+        if got.Packet != want.Packet || ! bytes.Equal(got.Body, want.Body) {
+            t.Fatalf("received %+v, want %+v", got, want)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("timed out waiting for message over the secure channel")
+    }
+}